@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+)
+
+// This file turns the sample into a simple inventory tool: discoverTargets walks every VM in
+// the subscription and emits them in the Prometheus file_sd format, so they can be dropped
+// straight into a Prometheus, Consul, or Ansible inventory. main runs mainDiscover when the
+// program's first argument is "discover".
+
+// exporterPort is the port appended to every discovered target, matching node_exporter's default.
+const exporterPort = 9100
+
+// fileSDTarget is a single entry of the Prometheus file_sd format.
+type fileSDTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// mainDiscover discovers VMs in the subscription and writes them to a Prometheus file_sd
+// target file, once by default or every --refresh seconds when that flag is positive.
+func mainDiscover() {
+	outputPath := flag.String("output", "azure_sd_targets.json", "path to write the Prometheus file_sd target file")
+	refresh := flag.Int("refresh", 0, "re-emit the target file every N seconds; 0 means emit once and exit")
+	flag.Parse()
+
+	for {
+		targets := discoverTargets()
+		writeTargetsFile(*outputPath, targets)
+		fmt.Printf("Wrote %d targets to '%s'\n", len(targets), *outputPath)
+
+		if *refresh <= 0 {
+			return
+		}
+		time.Sleep(time.Duration(*refresh) * time.Second)
+	}
+}
+
+// discoverTargets lists every VM in the subscription and, for each one, resolves its network
+// interfaces and IP addresses into a Prometheus file_sd target.
+func discoverTargets() []fileSDTarget {
+	list, err := vmClient.ListAll()
+	onErrorFail(err, "ListAll failed")
+
+	var targets []fileSDTarget
+	if list.Value == nil {
+		return targets
+	}
+
+	for _, vm := range *list.Value {
+		targets = append(targets, discoverVMTarget(vm))
+	}
+
+	return targets
+}
+
+// discoverVMTarget builds the file_sd target for a single VM.
+func discoverVMTarget(vm compute.VirtualMachine) fileSDTarget {
+	labels := map[string]string{
+		"__meta_azure_machine_name":     *vm.Name,
+		"__meta_azure_machine_location": *vm.Location,
+	}
+	if vm.HardwareProfile != nil {
+		labels["__meta_azure_machine_size"] = string(vm.HardwareProfile.VMSize)
+	}
+	if vm.StorageProfile != nil && vm.StorageProfile.OsDisk != nil {
+		labels["__meta_azure_machine_os_type"] = string(vm.StorageProfile.OsDisk.OsType)
+	}
+	if vm.Tags != nil {
+		for k, v := range *vm.Tags {
+			labels["__meta_azure_machine_tag_"+k] = *v
+		}
+	}
+
+	var privateIP, publicIP string
+	if vm.NetworkProfile != nil && vm.NetworkProfile.NetworkInterfaces != nil {
+		for _, nicRef := range *vm.NetworkProfile.NetworkInterfaces {
+			nicName := lastPathSegment(*nicRef.ID)
+			nic, err := interfacesClient.Get(resourceGroupOf(*nicRef.ID), nicName, "")
+			onErrorFail(err, "Get '%s' failed", nicName)
+
+			if nic.IPConfigurations == nil {
+				continue
+			}
+			for _, ipConfig := range *nic.IPConfigurations {
+				if ipConfig.PrivateIPAddress != nil {
+					privateIP = *ipConfig.PrivateIPAddress
+				}
+				if ipConfig.PublicIPAddress != nil {
+					pipName := lastPathSegment(*ipConfig.PublicIPAddress.ID)
+					pip, err := addressClient.Get(resourceGroupOf(*ipConfig.PublicIPAddress.ID), pipName, "")
+					onErrorFail(err, "Get '%s' failed", pipName)
+					if pip.IPAddress != nil {
+						publicIP = *pip.IPAddress
+					}
+				}
+			}
+		}
+	}
+	labels["__meta_azure_machine_private_ip"] = privateIP
+	labels["__meta_azure_machine_public_ip"] = publicIP
+
+	target := privateIP
+	if target == "" {
+		target = publicIP
+	}
+
+	return fileSDTarget{
+		Targets: []string{fmt.Sprintf("%s:%d", target, exporterPort)},
+		Labels:  labels,
+	}
+}
+
+// lastPathSegment returns the last "/"-separated segment of an ARM resource ID, i.e. its name.
+func lastPathSegment(id string) string {
+	parts := strings.Split(id, "/")
+	return parts[len(parts)-1]
+}
+
+// resourceGroupOf returns the resource group named in an ARM resource ID, or "" if it names none.
+func resourceGroupOf(id string) string {
+	parts := strings.Split(id, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+// writeTargetsFile marshals targets as JSON and writes them to path.
+func writeTargetsFile(path string, targets []fileSDTarget) {
+	data, err := json.MarshalIndent(targets, "", "  ")
+	onErrorFail(err, "Marshal targets failed")
+
+	err = ioutil.WriteFile(path, data, 0644)
+	onErrorFail(err, "WriteFile '%s' failed", path)
+}
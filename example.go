@@ -2,77 +2,146 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/Azure/azure-sdk-for-go/arm/compute"
 	"github.com/Azure/azure-sdk-for-go/arm/network"
 	"github.com/Azure/azure-sdk-for-go/arm/resources/resources"
-	"github.com/Azure/azure-sdk-for-go/arm/storage"
 	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/mcardosos/virtual-machines-go-manage/internal/asyncop"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	vhdURItemplate = "https://%s.blob.core.windows.net/golangcontainer/%s.vhd"
-	linuxVMname    = "linuxVM"
-	windowsVMname  = "windowsVM"
+	linuxVMname   = "linuxVM"
+	windowsVMname = "windowsVM"
+	adminUsername = "notadmin"
 )
 
 // This example requires that the following environment vars are set:
 //
 // AZURE_AUTH_LOCATION: contains the path to the Azure authentication file created by the Azure CLI
+// SSH_PUBLIC_KEY_PATH: contains the path to the SSH public key injected into the Linux VM's authorized_keys
+// CLOUD_INIT_FILE_PATH: contains the path to a cloud-init script run as the Linux VM's customData on first boot
 
 var (
-	groupName   = "your-azure-sample-group"
-	accountName = "golangrocksonazure"
-	location    = "westus"
+	groupName = "your-azure-sample-group"
+	location  = "westus"
 
 	groupClient      resources.GroupsClient
-	accountClient    storage.AccountsClient
 	vNetClient       network.VirtualNetworksClient
 	subnetClient     network.SubnetsClient
 	addressClient    network.PublicIPAddressesClient
 	interfacesClient network.InterfacesClient
 	vmClient         compute.VirtualMachinesClient
+	snapshotsClient  compute.SnapshotsClient
+	imagesClient     compute.ImagesClient
+	nsgClient        network.SecurityGroupsClient
+	secRulesClient   network.SecurityRulesClient
+
+	sourceAddressPrefix = flag.String("source-address-prefix", "", "CIDR allowed to reach SSH/RDP on the created VMs; defaults to the caller's public IP")
 )
 
 func init() {
 	createClients()
 }
 func main() {
-	subnet := createNeededResources()
-	defer groupClient.Delete(groupName, nil)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "discover":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			mainDiscover()
+			return
+		case "vmss":
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+			mainVMSS()
+			return
+		}
+	}
+
+	flag.Parse()
+	if *sourceAddressPrefix == "" {
+		*sourceAddressPrefix = discoverCallerIP() + "/32"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), asyncop.DefaultTimeout)
+	defer cancel()
 
-	go createVM(linuxVMname, "Canonical", "UbuntuServer", "16.04.0-LTS", subnet)
-	createVM(windowsVMname, "MicrosoftWindowsServer", "WindowsServer", "2016-Datacenter", subnet)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Println("\nReceived interrupt, cancelling in-flight operations...")
+		cancel()
+	}()
+	defer deleteResourceGroup(context.Background())
+
+	subnet := createNeededResources(ctx)
+
+	sshPublicKey := readFileOrExit(getEnvVarOrExit("SSH_PUBLIC_KEY_PATH"))
+	cloudInitScript := readFileOrExit(getEnvVarOrExit("CLOUD_INIT_FILE_PATH"))
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return createVM(gctx, linuxVMname, "Canonical", "UbuntuServer", "16.04.0-LTS", subnet, sshPublicKey, cloudInitScript)
+	})
+	g.Go(func() error {
+		return createVM(gctx, windowsVMname, "MicrosoftWindowsServer", "WindowsServer", "2016-Datacenter", subnet, "", "")
+	})
+	if err := g.Wait(); err != nil {
+		fmt.Printf("Creating VMs failed: %s\n", err)
+		return
+	}
 
 	fmt.Println("Your Linux VM and Windows VM have been created")
 	fmt.Print("Press enter to perform various operations on the virtual machines...")
 	var input string
 	fmt.Scanln(&input)
 
-	go vmOperations(linuxVMname)
-	vmOperations(windowsVMname)
+	g, gctx = errgroup.WithContext(ctx)
+	g.Go(func() error { return vmOperations(gctx, linuxVMname) })
+	g.Go(func() error { return vmOperations(gctx, windowsVMname) })
+	if err := g.Wait(); err != nil {
+		fmt.Printf("Performing VM operations failed: %s\n", err)
+		return
+	}
 
 	listVMs()
 
 	fmt.Print("Press enter to delete the VMs and other resources created in this sample...")
 	fmt.Scanln(&input)
 
-	go deleteVM(linuxVMname)
-	deleteVM(windowsVMname)
+	g, gctx = errgroup.WithContext(ctx)
+	g.Go(func() error { return deleteVM(gctx, linuxVMname) })
+	g.Go(func() error { return deleteVM(gctx, windowsVMname) })
+	if err := g.Wait(); err != nil {
+		fmt.Printf("Deleting VMs failed: %s\n", err)
+		return
+	}
+
+	fmt.Println("Done!")
+}
 
+// deleteResourceGroup deletes the resource group created for this sample. It is always called
+// with a fresh, non-cancelled context so it still runs to completion after a Ctrl-C.
+func deleteResourceGroup(ctx context.Context) {
 	fmt.Println("Starting to delete the resource group...")
-	_, errGroup := groupClient.Delete(groupName, nil)
-	onErrorFail(<-errGroup, "Delete resource group failed")
+	_, errChan := groupClient.Delete(groupName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "Delete resource group", errChan), "Delete resource group failed")
 	fmt.Println("... resource group deleted")
-
-	fmt.Println("Done!")
 }
 
 // createNeededResources creates all common resources needed before creating VMs.
-func createNeededResources() *network.Subnet {
+func createNeededResources(ctx context.Context) *network.Subnet {
 	fmt.Println("Create needed resources")
 	fmt.Println("\tCreate resource group...")
 	resourceGroupParameters := resources.Group{
@@ -81,18 +150,7 @@ func createNeededResources() *network.Subnet {
 	_, err := groupClient.CreateOrUpdate(groupName, resourceGroupParameters)
 	onErrorFail(err, "CreateOrUpdate resource group failed")
 
-	errStorage := make(<-chan error)
-	go func() {
-		fmt.Println("\tStarting to create storage account...")
-		accountParameters := storage.AccountCreateParameters{
-			Sku: &storage.Sku{
-				Name: storage.StandardLRS,
-			},
-			Location: &location,
-			AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{},
-		}
-		_, errStorage = accountClient.Create(groupName, accountName, accountParameters, nil)
-	}()
+	nsg := createNSG(ctx)
 
 	fmt.Println("\tStarting to create virtual network...")
 	vNetName := "vNet"
@@ -104,52 +162,116 @@ func createNeededResources() *network.Subnet {
 			},
 		},
 	}
-	_, errVnet := vNetClient.CreateOrUpdate(groupName, vNetName, vNetParameters, nil)
-	onErrorFail(<-errVnet, "CreateOrUpdate virtual network failed")
+	_, errVnet := vNetClient.CreateOrUpdate(groupName, vNetName, vNetParameters, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate virtual network", errVnet), "CreateOrUpdate virtual network failed")
 	fmt.Println("... virtual network created")
 
 	fmt.Println("\tStarting to create subnet...")
 	subnetName := "subnet"
 	subnet := network.Subnet{
 		SubnetPropertiesFormat: &network.SubnetPropertiesFormat{
-			AddressPrefix: to.StringPtr("10.0.0.0/24"),
+			AddressPrefix:        to.StringPtr("10.0.0.0/24"),
+			NetworkSecurityGroup: nsg,
 		},
 	}
-	_, errSubnet := subnetClient.CreateOrUpdate(groupName, vNetName, subnetName, subnet, nil)
-	onErrorFail(<-errSubnet, "CreateOrUpdate virtual network failed")
+	_, errSubnet := subnetClient.CreateOrUpdate(groupName, vNetName, subnetName, subnet, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate subnet", errSubnet), "CreateOrUpdate subnet failed")
 	fmt.Println("... subnet created")
 
 	fmt.Println("\tGet subnet info...")
 	subnet, err = subnetClient.Get(groupName, vNetName, subnetName, "")
 	onErrorFail(err, "Get subnet failed")
 
-	onErrorFail(<-errStorage, "Create storage account failed")
-	fmt.Println("... storage account created")
-
 	return &subnet
 }
 
-// createVM creates a VM in the provided subnet.
-func createVM(vmName, publisher, offer, sku string, subnet *network.Subnet) error {
-	publicIPaddress, nicParameters := createPIPandNIC(vmName, subnet)
+// createNSG creates a network security group allowing inbound SSH (Linux) and RDP (Windows)
+// from sourceAddressPrefix only, denying everything else, and returns it ready to be attached
+// to a subnet.
+func createNSG(ctx context.Context) *network.SecurityGroup {
+	fmt.Println("\tStarting to create network security group...")
+	nsgName := "nsg-harden"
+	nsgParameters := network.SecurityGroup{
+		Location:                      &location,
+		SecurityGroupPropertiesFormat: &network.SecurityGroupPropertiesFormat{},
+	}
+	_, errNSG := nsgClient.CreateOrUpdate(groupName, nsgName, nsgParameters, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+nsgName+"'", errNSG), "CreateOrUpdate '%s' failed", nsgName)
+	fmt.Println("... network security group created")
+
+	createSecurityRule(ctx, nsgName, "allow-ssh", "22", *sourceAddressPrefix, network.SecurityRuleProtocolTCP, network.SecurityRuleAccessAllow, 100)
+	createSecurityRule(ctx, nsgName, "allow-rdp", "3389", *sourceAddressPrefix, network.SecurityRuleProtocolTCP, network.SecurityRuleAccessAllow, 101)
+	createSecurityRule(ctx, nsgName, "deny-all-inbound", "*", "*", network.SecurityRuleProtocolAsterisk, network.SecurityRuleAccessDeny, 4096)
+
+	nsg, err := nsgClient.Get(groupName, nsgName, "")
+	onErrorFail(err, "Get '%s' failed", nsgName)
+
+	return &nsg
+}
+
+// createSecurityRule creates a single inbound security rule on the given network security group.
+func createSecurityRule(ctx context.Context, nsgName, ruleName, destinationPort, sourceAddressPrefix string, protocol network.SecurityRuleProtocol, access network.SecurityRuleAccess, priority int32) {
+	rule := network.SecurityRule{
+		SecurityRulePropertiesFormat: &network.SecurityRulePropertiesFormat{
+			Protocol:                 protocol,
+			SourceAddressPrefix:      to.StringPtr(sourceAddressPrefix),
+			SourcePortRange:          to.StringPtr("*"),
+			DestinationAddressPrefix: to.StringPtr("*"),
+			DestinationPortRange:     to.StringPtr(destinationPort),
+			Access:                   access,
+			Direction:                network.Inbound,
+			Priority:                 to.Int32Ptr(priority),
+		},
+	}
+	_, errChan := secRulesClient.CreateOrUpdate(groupName, nsgName, ruleName, rule, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+ruleName+"'", errChan), "CreateOrUpdate '%s' failed", ruleName)
+}
+
+// discoverCallerIP looks up the public IP address this program is running from, so
+// --source-address-prefix can default to something narrower than 0.0.0.0/0.
+func discoverCallerIP() string {
+	resp, err := http.Get("https://api.ipify.org")
+	onErrorFail(err, "Discovering caller public IP failed")
+	defer resp.Body.Close()
+
+	ip, err := ioutil.ReadAll(resp.Body)
+	onErrorFail(err, "Reading caller public IP failed")
+
+	return strings.TrimSpace(string(ip))
+}
+
+// createVM creates a VM in the provided subnet. sshPublicKey and cloudInitScript are optional;
+// when sshPublicKey is provided the VM is provisioned for key-based, password-less login instead
+// of the hard-coded admin password.
+func createVM(ctx context.Context, vmName, publisher, offer, sku string, subnet *network.Subnet, sshPublicKey, cloudInitScript string) error {
+	publicIPaddress, nicParameters := createPIPandNIC(ctx, vmName, subnet)
 
 	fmt.Printf("Create '%s' VM...\n", vmName)
-	vm := setVMparameters(vmName, publisher, offer, sku, *nicParameters.ID)
-	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, vm, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", vmName)
+	vm := setVMparameters(vmName, publisher, offer, sku, *nicParameters.ID, sshPublicKey, cloudInitScript)
+	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, vm, asyncop.CancelChannel(ctx))
+	if err := asyncop.Do(ctx, "CreateOrUpdate '"+vmName+"'", errChan); err != nil {
+		return fmt.Errorf("CreateOrUpdate '%s' failed: %w", vmName, err)
+	}
 
-	fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
-		vmName,
-		*vm.OsProfile.AdminUsername,
-		*publicIPaddress.DNSSettings.Fqdn,
-		*vm.OsProfile.AdminPassword)
+	if vm.OsProfile.LinuxConfiguration != nil && *vm.OsProfile.LinuxConfiguration.DisablePasswordAuthentication {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' using your SSH key\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*publicIPaddress.DNSSettings.Fqdn)
+	} else {
+		fmt.Printf("Now you can connect to '%s' VM via 'ssh %s@%s' with password '%s'\n",
+			vmName,
+			*vm.OsProfile.AdminUsername,
+			*publicIPaddress.DNSSettings.Fqdn,
+			*vm.OsProfile.AdminPassword)
+	}
 
 	return nil
 }
 
 // createPIPandNIC creates a public IP address and a network interface in an existing subnet.
 // It returns a network interface ready to be used to create a virtual machine.
-func createPIPandNIC(machine string, subnet *network.Subnet) (*network.PublicIPAddress, *network.Interface) {
+func createPIPandNIC(ctx context.Context, machine string, subnet *network.Subnet) (*network.PublicIPAddress, *network.Interface) {
 	fmt.Printf("Create PIP and NIC for %s VM...\n", machine)
 	IPname := fmt.Sprintf("pip-%s", machine)
 	fmt.Printf("\tStarting to create public IP address '%v'...\n", IPname)
@@ -161,8 +283,8 @@ func createPIPandNIC(machine string, subnet *network.Subnet) (*network.PublicIPA
 			},
 		},
 	}
-	_, errPIP := addressClient.CreateOrUpdate(groupName, IPname, pip, nil)
-	onErrorFail(<-errPIP, "CreateOrUpdate '%s' failed", IPname)
+	_, errPIP := addressClient.CreateOrUpdate(groupName, IPname, pip, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+IPname+"'", errPIP), "CreateOrUpdate '%s' failed", IPname)
 	fmt.Printf("... public IP address '%v' created\n", IPname)
 
 	fmt.Printf("\tGet IP address '%s' info...\n", IPname)
@@ -186,8 +308,8 @@ func createPIPandNIC(machine string, subnet *network.Subnet) (*network.PublicIPA
 			},
 		},
 	}
-	_, errChan := interfacesClient.CreateOrUpdate(groupName, nicName, nic, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", nicName)
+	_, errChan := interfacesClient.CreateOrUpdate(groupName, nicName, nic, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+nicName+"'", errChan), "CreateOrUpdate '%s' failed", nicName)
 	fmt.Printf("... NIC '%v' created\n", nicName)
 
 	fmt.Println("\tGet NIC info...")
@@ -197,8 +319,34 @@ func createPIPandNIC(machine string, subnet *network.Subnet) (*network.PublicIPA
 	return &pip, &nic
 }
 
-// setVMparameters builds the VirtualMachine argument for creating or updating a VM.
-func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.VirtualMachine {
+// setVMparameters builds the VirtualMachine argument for creating or updating a VM. When
+// sshPublicKey is non-empty, the VM is set up for SSH key authentication with password
+// authentication disabled instead of the AdminPassword; cloudInitScript, if non-empty, is
+// base64-encoded into CustomData and run by cloud-init on first boot.
+func setVMparameters(vmName, publisher, offer, sku, nicID, sshPublicKey, cloudInitScript string) compute.VirtualMachine {
+	osProfile := &compute.OSProfile{
+		ComputerName:  &vmName,
+		AdminUsername: to.StringPtr(adminUsername),
+	}
+	if sshPublicKey != "" {
+		osProfile.LinuxConfiguration = &compute.LinuxConfiguration{
+			DisablePasswordAuthentication: to.BoolPtr(true),
+			SSH: &compute.SSHConfiguration{
+				PublicKeys: &[]compute.SSHPublicKey{
+					{
+						Path:    to.StringPtr(fmt.Sprintf("/home/%s/.ssh/authorized_keys", adminUsername)),
+						KeyData: to.StringPtr(sshPublicKey),
+					},
+				},
+			},
+		}
+	} else {
+		osProfile.AdminPassword = to.StringPtr("Pa$$w0rd1975")
+	}
+	if cloudInitScript != "" {
+		osProfile.CustomData = to.StringPtr(base64.StdEncoding.EncodeToString([]byte(cloudInitScript)))
+	}
+
 	return compute.VirtualMachine{
 		Location: &location,
 		VirtualMachineProperties: &compute.VirtualMachineProperties{
@@ -214,17 +362,13 @@ func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.Virtua
 				},
 				OsDisk: &compute.OSDisk{
 					Name: to.StringPtr("osDisk"),
-					Vhd: &compute.VirtualHardDisk{
-						URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, vmName)),
+					ManagedDisk: &compute.ManagedDiskParameters{
+						StorageAccountType: compute.StandardSSDLRS,
 					},
 					CreateOption: compute.DiskCreateOptionTypesFromImage,
 				},
 			},
-			OsProfile: &compute.OSProfile{
-				ComputerName:  &vmName,
-				AdminUsername: to.StringPtr("notadmin"),
-				AdminPassword: to.StringPtr("Pa$$w0rd1975"),
-			},
+			OsProfile: osProfile,
 			NetworkProfile: &compute.NetworkProfile{
 				NetworkInterfaces: &[]compute.NetworkInterfaceReference{
 					{
@@ -240,17 +384,21 @@ func setVMparameters(vmName, publisher, offer, sku, nicID string) compute.Virtua
 }
 
 // vmOperations performs simple VM operations.
-func vmOperations(vmName string) {
+func vmOperations(ctx context.Context, vmName string) error {
 	fmt.Printf("Performing various operations on '%s' VM\n", vmName)
 	vm := getVM(vmName)
 
-	updateVM(vmName, vm)
-	attachDataDisk(vmName, vm)
-	detachDataDisks(vmName, vm)
-	updateOSdiskSize(vmName, vm)
-	startVM(vmName)
-	restartVM(vmName)
-	stopVM(vmName)
+	updateVM(ctx, vmName, vm)
+	attachDataDisk(ctx, vmName, vm)
+	detachDataDisks(ctx, vmName, vm)
+	updateOSdiskSize(ctx, vmName, vm)
+	startVM(ctx, vmName)
+	restartVM(ctx, vmName)
+	stopVM(ctx, vmName)
+	snapshotVM(ctx, vmName, vm)
+	captureImage(ctx, vmName, vm)
+
+	return nil
 }
 
 func getVM(vmName string) *compute.VirtualMachine {
@@ -261,74 +409,116 @@ func getVM(vmName string) *compute.VirtualMachine {
 	return &vm
 }
 
-func updateVM(vmName string, vm *compute.VirtualMachine) {
+func updateVM(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Tag VM '%s' (via CreateOrUpdate operation)\n", vmName)
 	vm.Tags = &(map[string]*string{
 		"who rocks": to.StringPtr("golang"),
 		"where":     to.StringPtr("on azure"),
 	})
-	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", vmName)
+	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+vmName+"'", errChan), "CreateOrUpdate '%s' failed", vmName)
 }
 
-func attachDataDisk(vmName string, vm *compute.VirtualMachine) {
+func attachDataDisk(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Attach data disk to '%s' (via CreateOrUpdate operation)\n", vmName)
 	vm.StorageProfile.DataDisks = &[]compute.DataDisk{
 		{
 			Lun:  to.Int32Ptr(0),
 			Name: to.StringPtr("dataDisk"),
-			Vhd: &compute.VirtualHardDisk{
-				URI: to.StringPtr(fmt.Sprintf(vhdURItemplate, accountName, fmt.Sprintf("dataDisks-%v", vmName))),
+			ManagedDisk: &compute.ManagedDiskParameters{
+				StorageAccountType: compute.PremiumLRS,
 			},
 			CreateOption: compute.DiskCreateOptionTypesEmpty,
 			DiskSizeGB:   to.Int32Ptr(1),
 		},
 	}
-	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", vmName)
+	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+vmName+"'", errChan), "CreateOrUpdate '%s' failed", vmName)
 }
 
-func detachDataDisks(vmName string, vm *compute.VirtualMachine) {
+func detachDataDisks(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Detach data disks from '%s' (via CreateOrUpdate operation)\n", vmName)
 	vm.StorageProfile.DataDisks = &[]compute.DataDisk{}
-	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", vmName)
+	_, errChan := vmClient.CreateOrUpdate(groupName, vmName, *vm, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+vmName+"'", errChan), "CreateOrUpdate '%s' failed", vmName)
 }
 
-func updateOSdiskSize(vmName string, vm *compute.VirtualMachine) {
+func updateOSdiskSize(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
 	fmt.Printf("Update OS disk size on '%s' (via Deallocate and CreateOrUpdate operations)\n", vmName)
 	if vm.StorageProfile.OsDisk.DiskSizeGB == nil {
 		vm.StorageProfile.OsDisk.DiskSizeGB = to.Int32Ptr(0)
 	}
 
-	_, errChan := vmClient.Deallocate(groupName, vmName, nil)
-	onErrorFail(<-errChan, "Deallocate '%s' failed", vmName)
+	_, errChan := vmClient.Deallocate(groupName, vmName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "Deallocate '"+vmName+"'", errChan), "Deallocate '%s' failed", vmName)
 
 	if *vm.StorageProfile.OsDisk.DiskSizeGB <= 0 {
 		*vm.StorageProfile.OsDisk.DiskSizeGB = 256
 	}
 	*vm.StorageProfile.OsDisk.DiskSizeGB += 10
 
-	_, errChan = vmClient.CreateOrUpdate(groupName, vmName, *vm, nil)
-	onErrorFail(<-errChan, "CreateOrUpdate '%s' failed", vmName)
+	_, errChan = vmClient.CreateOrUpdate(groupName, vmName, *vm, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+vmName+"'", errChan), "CreateOrUpdate '%s' failed", vmName)
 }
 
-func startVM(vmName string) {
+func startVM(ctx context.Context, vmName string) {
 	fmt.Printf("Start VM '%s'...\n", vmName)
-	_, errChan := vmClient.Start(groupName, vmName, nil)
-	onErrorFail(<-errChan, "Start '%s' failed", vmName)
+	_, errChan := vmClient.Start(groupName, vmName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "Start '"+vmName+"'", errChan), "Start '%s' failed", vmName)
 }
 
-func restartVM(vmName string) {
+func restartVM(ctx context.Context, vmName string) {
 	fmt.Printf("Restart VM '%s'...\n", vmName)
-	_, errChan := vmClient.Restart(groupName, vmName, nil)
-	onErrorFail(<-errChan, "Restart '%s' failed", vmName)
+	_, errChan := vmClient.Restart(groupName, vmName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "Restart '"+vmName+"'", errChan), "Restart '%s' failed", vmName)
 }
 
-func stopVM(vmName string) {
+func stopVM(ctx context.Context, vmName string) {
 	fmt.Printf("Stop VM '%s'...\n", vmName)
-	_, errChan := vmClient.PowerOff(groupName, vmName, nil)
-	onErrorFail(<-errChan, "Stop '%s' failed", vmName)
+	_, errChan := vmClient.PowerOff(groupName, vmName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "PowerOff '"+vmName+"'", errChan), "Stop '%s' failed", vmName)
+}
+
+// snapshotVM takes a snapshot of the OS disk of the given VM.
+func snapshotVM(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
+	fmt.Printf("Snapshot OS disk of '%s' (via SnapshotsClient.CreateOrUpdate operation)\n", vmName)
+	snapshotName := fmt.Sprintf("snapshot-%s", vmName)
+	snapshot := compute.Snapshot{
+		Location: &location,
+		DiskProperties: &compute.DiskProperties{
+			CreationData: &compute.CreationData{
+				CreateOption:     compute.Copy,
+				SourceResourceID: vm.StorageProfile.OsDisk.ManagedDisk.ID,
+			},
+		},
+	}
+	_, errChan := snapshotsClient.CreateOrUpdate(groupName, snapshotName, snapshot, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+snapshotName+"'", errChan), "CreateOrUpdate '%s' failed", snapshotName)
+}
+
+// captureImage creates an Image from the snapshot taken of the given VM's OS disk,
+// so the VM can later be re-deployed from that image.
+func captureImage(ctx context.Context, vmName string, vm *compute.VirtualMachine) {
+	fmt.Printf("Capture image from snapshot of '%s' (via ImagesClient.CreateOrUpdate operation)\n", vmName)
+	snapshot, err := snapshotsClient.Get(groupName, fmt.Sprintf("snapshot-%s", vmName))
+	onErrorFail(err, "Get snapshot for '%s' failed", vmName)
+
+	imageName := fmt.Sprintf("image-%s", vmName)
+	image := compute.Image{
+		Location: &location,
+		ImageProperties: &compute.ImageProperties{
+			StorageProfile: &compute.ImageStorageProfile{
+				OsDisk: &compute.ImageOSDisk{
+					OsType:             vm.StorageProfile.OsDisk.OsType,
+					OsState:            compute.Generalized,
+					Snapshot:           &compute.SubResource{ID: snapshot.ID},
+					StorageAccountType: compute.StandardSSDLRS,
+				},
+			},
+		},
+	}
+	_, errChan := imagesClient.CreateOrUpdate(groupName, imageName, image, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+imageName+"'", errChan), "CreateOrUpdate '%s' failed", imageName)
 }
 
 func listVMs() {
@@ -346,11 +536,14 @@ func listVMs() {
 	}
 }
 
-func deleteVM(vmName string) {
+func deleteVM(ctx context.Context, vmName string) error {
 	fmt.Printf("Delete '%s' virtual machine...\n", vmName)
-	_, errChan := vmClient.Delete(groupName, vmName, nil)
-	err := <-errChan
-	onErrorFail(err, "Delete '%s' failed", vmName)
+	_, errChan := vmClient.Delete(groupName, vmName, asyncop.CancelChannel(ctx))
+	if err := asyncop.Do(ctx, "Delete '"+vmName+"'", errChan); err != nil {
+		return fmt.Errorf("Delete '%s' failed: %w", vmName, err)
+	}
+
+	return nil
 }
 
 // printVM prints basic info about a Virtual Machine.
@@ -385,6 +578,17 @@ func getEnvVarOrExit(varName string) string {
 	return value
 }
 
+// readFileOrExit returns the contents of the file at path or terminates if it cannot be read.
+func readFileOrExit(path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Could not read file %s: %s\n", path, err)
+		os.Exit(1)
+	}
+
+	return string(content)
+}
+
 // onErrorFail prints a failure message and exits the program if err is not nil.
 func onErrorFail(err error, message string, a ...interface{}) {
 	if err != nil {
@@ -399,11 +603,6 @@ func createClients() (err error) {
 		return
 	}
 
-	accountClient, err = storage.NewAccountsClientWithAuthFile()
-	if err != nil {
-		return
-	}
-
 	vNetClient, err = network.NewVirtualNetworksClientWithAuthFile()
 	if err != nil {
 		return
@@ -429,5 +628,40 @@ func createClients() (err error) {
 		return
 	}
 
+	snapshotsClient, err = compute.NewSnapshotsClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	imagesClient, err = compute.NewImagesClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	lbClient, err = network.NewLoadBalancersClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	vmssClient, err = compute.NewVirtualMachineScaleSetsClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	vmssVMsClient, err = compute.NewVirtualMachineScaleSetVMsClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	nsgClient, err = network.NewSecurityGroupsClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
+	secRulesClient, err = network.NewSecurityRulesClientWithAuthFile()
+	if err != nil {
+		return
+	}
+
 	return
 }
@@ -0,0 +1,65 @@
+// Package asyncop makes the track-1 azure-sdk-for-go ARM clients' long-running operations
+// (CreateOrUpdate, Delete, Start, ...) cancellable through a context.Context, with a bounded
+// DefaultTimeout so a stalled call can't hang forever. Every such client method accepts a
+// `cancel <-chan struct{}` argument that the SDK polls alongside the Azure-AsyncOperation/Location
+// header it's tracking: closing it makes the client stop polling and return promptly.
+// CancelChannel adapts a context into that argument, and Wait/Do replace the old `<-errChan`
+// blocking read with one that also reports progress while it waits.
+package asyncop
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultTimeout bounds how long a run is allowed to wait on ARM operations before giving up and
+// cancelling them itself, so a stalled call can't hang forever with nobody around to Ctrl-C it.
+const DefaultTimeout = 30 * time.Minute
+
+// ProgressFunc is invoked on every tick while an operation is still in flight.
+type ProgressFunc func(elapsed time.Duration)
+
+// CancelChannel returns a channel that closes when ctx is done, suitable for passing as the
+// track-1 SDK's `cancel <-chan struct{}` argument so that cancelling ctx actually stops the
+// client's in-flight polling instead of merely abandoning our wait on it.
+func CancelChannel(ctx context.Context) <-chan struct{} {
+	cancel := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		close(cancel)
+	}()
+	return cancel
+}
+
+// Wait blocks until errChan resolves, invoking onProgress (if non-nil) every tick while it
+// waits. Once ctx is done it stops selecting on it — by then the caller is expected to have
+// passed CancelChannel(ctx) as the operation's own cancel argument, so errChan will resolve on
+// its own shortly after as the client unwinds; Wait keeps waiting for that real resolution
+// rather than returning early and racing the still-running operation.
+func Wait(ctx context.Context, errChan <-chan error, tick time.Duration, onProgress ProgressFunc) error {
+	start := time.Now()
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	ctxDone := ctx.Done()
+	for {
+		select {
+		case err := <-errChan:
+			return err
+		case <-ctxDone:
+			ctxDone = nil
+		case <-ticker.C:
+			if onProgress != nil {
+				onProgress(time.Since(start))
+			}
+		}
+	}
+}
+
+// Do waits on errChan with a default tick, printing name and elapsed time on every tick.
+func Do(ctx context.Context, name string, errChan <-chan error) error {
+	return Wait(ctx, errChan, 15*time.Second, func(elapsed time.Duration) {
+		fmt.Printf("\t...still waiting on %s (%s elapsed)\n", name, elapsed.Round(time.Second))
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Azure/azure-sdk-for-go/arm/compute"
+	"github.com/Azure/azure-sdk-for-go/arm/network"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/mcardosos/virtual-machines-go-manage/internal/asyncop"
+)
+
+// This file demonstrates managing a fleet of VMs with a Virtual Machine Scale Set instead of
+// the single-VM flow in example.go. main runs mainVMSS when the program's first argument is
+// "vmss".
+
+const vmssName = "linuxVMSS"
+
+var (
+	lbClient      network.LoadBalancersClient
+	vmssClient    compute.VirtualMachineScaleSetsClient
+	vmssVMsClient compute.VirtualMachineScaleSetVMsClient
+)
+
+// mainVMSS walks through creating a scale set behind a load balancer, scaling it, rolling an
+// OS image upgrade across its instances and listing each instance's status.
+func mainVMSS() {
+	flag.Parse()
+	if *sourceAddressPrefix == "" {
+		*sourceAddressPrefix = discoverCallerIP() + "/32"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), asyncop.DefaultTimeout)
+	defer cancel()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		fmt.Println("\nReceived interrupt, cancelling in-flight operations...")
+		cancel()
+	}()
+	defer deleteResourceGroup(context.Background())
+
+	subnet := createNeededResources(ctx)
+
+	lb := createLoadBalancer(ctx, subnet)
+
+	fmt.Println("Create VM scale set")
+	createVMSS(ctx, vmssName, "Canonical", "UbuntuServer", "16.04.0-LTS", 2, subnet, lb)
+
+	fmt.Print("Press enter to scale the VM scale set up to 4 instances...")
+	var input string
+	fmt.Scanln(&input)
+	scaleVMSS(ctx, vmssName, 4)
+
+	fmt.Print("Press enter to roll out an OS image upgrade...")
+	fmt.Scanln(&input)
+	upgradeVMSSImage(ctx, vmssName, "latest")
+
+	listVMSSinstanceViews(vmssName)
+
+	fmt.Print("Press enter to delete the VM scale set and other resources created in this sample...")
+	fmt.Scanln(&input)
+
+	_, errChan := vmssClient.Delete(groupName, vmssName, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "Delete '"+vmssName+"'", errChan), "Delete '%s' failed", vmssName)
+
+	fmt.Println("Done!")
+}
+
+// createLoadBalancer creates a load balancer, fronting the scale set instances, with a single
+// frontend IP, a backend address pool and a load balancing rule for SSH on port 22, health
+// checked by a TCP probe. The rule leaves the load distribution mode at Azure's default.
+func createLoadBalancer(ctx context.Context, subnet *network.Subnet) *network.LoadBalancer {
+	fmt.Println("Create load balancer for VM scale set...")
+	lbName := "lb-" + vmssName
+	frontEndIPConfigName := "lbFrontEnd"
+	backendAddressPoolName := "lbBackEndPool"
+	probeName := "lbProbe"
+
+	frontEndIPConfigID := fmt.Sprintf(
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s/frontendIPConfigurations/%s",
+		lbClient.SubscriptionID, groupName, lbName, frontEndIPConfigName)
+	backendAddressPoolID := fmt.Sprintf(
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s/backendAddressPools/%s",
+		lbClient.SubscriptionID, groupName, lbName, backendAddressPoolName)
+	probeID := fmt.Sprintf(
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Network/loadBalancers/%s/probes/%s",
+		lbClient.SubscriptionID, groupName, lbName, probeName)
+
+	lb := network.LoadBalancer{
+		Location: &location,
+		LoadBalancerPropertiesFormat: &network.LoadBalancerPropertiesFormat{
+			FrontendIPConfigurations: &[]network.FrontendIPConfiguration{
+				{
+					Name: &frontEndIPConfigName,
+					FrontendIPConfigurationPropertiesFormat: &network.FrontendIPConfigurationPropertiesFormat{
+						PrivateIPAllocationMethod: network.Dynamic,
+						Subnet: subnet,
+					},
+				},
+			},
+			BackendAddressPools: &[]network.BackendAddressPool{
+				{Name: &backendAddressPoolName},
+			},
+			Probes: &[]network.Probe{
+				{
+					Name: &probeName,
+					ProbePropertiesFormat: &network.ProbePropertiesFormat{
+						Protocol:          network.ProbeProtocolTCP,
+						Port:              to.Int32Ptr(22),
+						IntervalInSeconds: to.Int32Ptr(15),
+						NumberOfProbes:    to.Int32Ptr(4),
+					},
+				},
+			},
+			LoadBalancingRules: &[]network.LoadBalancingRule{
+				{
+					Name: to.StringPtr("lbRuleSSH"),
+					LoadBalancingRulePropertiesFormat: &network.LoadBalancingRulePropertiesFormat{
+						Protocol:                network.TransportProtocolTCP,
+						FrontendPort:            to.Int32Ptr(22),
+						BackendPort:             to.Int32Ptr(22),
+						IdleTimeoutInMinutes:    to.Int32Ptr(4),
+						FrontendIPConfiguration: &network.SubResource{ID: to.StringPtr(frontEndIPConfigID)},
+						BackendAddressPool:      &network.SubResource{ID: to.StringPtr(backendAddressPoolID)},
+						Probe:                   &network.SubResource{ID: to.StringPtr(probeID)},
+					},
+				},
+			},
+		},
+	}
+	_, errChan := lbClient.CreateOrUpdate(groupName, lbName, lb, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+lbName+"'", errChan), "CreateOrUpdate '%s' failed", lbName)
+	fmt.Println("... load balancer created")
+
+	createdLB, err := lbClient.Get(groupName, lbName, "")
+	onErrorFail(err, "Get '%s' failed", lbName)
+
+	return &createdLB
+}
+
+// createVMSS creates a Virtual Machine Scale Set of the given initial capacity, with instances
+// spread across the provided subnet and load-balanced through lb.
+func createVMSS(ctx context.Context, name, publisher, offer, sku string, capacity int64, subnet *network.Subnet, lb *network.LoadBalancer) compute.VirtualMachineScaleSet {
+	ipConfigName := "vmssIPconfig"
+	nicConfigName := "vmssNIC"
+
+	vmss := compute.VirtualMachineScaleSet{
+		Location: &location,
+		Sku: &compute.Sku{
+			Name:     to.StringPtr("Standard_DS1_v2"),
+			Tier:     to.StringPtr("Standard"),
+			Capacity: to.Int64Ptr(capacity),
+		},
+		VirtualMachineScaleSetProperties: &compute.VirtualMachineScaleSetProperties{
+			Overprovision: to.BoolPtr(false),
+			UpgradePolicy: &compute.UpgradePolicy{
+				Mode: compute.Manual,
+			},
+			VirtualMachineProfile: &compute.VirtualMachineScaleSetVMProfile{
+				OsProfile: &compute.VirtualMachineScaleSetOSProfile{
+					ComputerNamePrefix: &name,
+					AdminUsername:      to.StringPtr(adminUsername),
+					AdminPassword:      to.StringPtr("Pa$$w0rd1975"),
+				},
+				StorageProfile: &compute.VirtualMachineScaleSetStorageProfile{
+					ImageReference: &compute.ImageReference{
+						Publisher: &publisher,
+						Offer:     &offer,
+						Sku:       &sku,
+						Version:   to.StringPtr("latest"),
+					},
+					OsDisk: &compute.VirtualMachineScaleSetOSDisk{
+						CreateOption: compute.DiskCreateOptionTypesFromImage,
+						ManagedDisk: &compute.VirtualMachineScaleSetManagedDiskParameters{
+							StorageAccountType: compute.StandardSSDLRS,
+						},
+					},
+				},
+				NetworkProfile: &compute.VirtualMachineScaleSetNetworkProfile{
+					NetworkInterfaceConfigurations: &[]compute.VirtualMachineScaleSetNetworkConfiguration{
+						{
+							Name: &nicConfigName,
+							VirtualMachineScaleSetNetworkConfigurationProperties: &compute.VirtualMachineScaleSetNetworkConfigurationProperties{
+								Primary: to.BoolPtr(true),
+								IPConfigurations: &[]compute.VirtualMachineScaleSetIPConfiguration{
+									{
+										Name: &ipConfigName,
+										VirtualMachineScaleSetIPConfigurationProperties: &compute.VirtualMachineScaleSetIPConfigurationProperties{
+											Subnet:                          &compute.APIEntityReference{ID: subnet.ID},
+											LoadBalancerBackendAddressPools: &[]compute.SubResource{{ID: (*lb.BackendAddressPools)[0].ID}},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	_, errChan := vmssClient.CreateOrUpdate(groupName, name, vmss, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+name+"'", errChan), "CreateOrUpdate '%s' failed", name)
+	fmt.Printf("... VM scale set '%s' created\n", name)
+
+	created, err := vmssClient.Get(groupName, name)
+	onErrorFail(err, "Get '%s' failed", name)
+
+	return created
+}
+
+// scaleVMSS changes the number of instances in the scale set by sending the whole scale set,
+// with its new capacity, through a CreateOrUpdate operation.
+func scaleVMSS(ctx context.Context, name string, capacity int64) {
+	fmt.Printf("Scale VM scale set '%s' to %d instances (via CreateOrUpdate operation)\n", name, capacity)
+	vmss, err := vmssClient.Get(groupName, name)
+	onErrorFail(err, "Get '%s' failed", name)
+
+	vmss.Sku.Capacity = to.Int64Ptr(capacity)
+	_, errChan := vmssClient.CreateOrUpdate(groupName, name, vmss, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+name+"'", errChan), "CreateOrUpdate '%s' failed", name)
+}
+
+// upgradeVMSSImage rolls out a new image version to every instance in the scale set.
+func upgradeVMSSImage(ctx context.Context, name, version string) {
+	fmt.Printf("Upgrade OS image on VM scale set '%s' instances to version '%s'\n", name, version)
+	vmss, err := vmssClient.Get(groupName, name)
+	onErrorFail(err, "Get '%s' failed", name)
+
+	vmss.VirtualMachineProfile.StorageProfile.ImageReference.Version = &version
+	_, errChan := vmssClient.CreateOrUpdate(groupName, name, vmss, asyncop.CancelChannel(ctx))
+	onErrorFail(asyncop.Do(ctx, "CreateOrUpdate '"+name+"'", errChan), "CreateOrUpdate '%s' failed", name)
+
+	instances, err := vmssVMsClient.List(groupName, name, "", "", "")
+	onErrorFail(err, "List instances of '%s' failed", name)
+
+	if instances.Value == nil {
+		return
+	}
+	for _, instance := range *instances.Value {
+		_, errChan := vmssVMsClient.UpdateInstances(groupName, name, compute.VirtualMachineScaleSetVMInstanceRequiredIDs{
+			InstanceIds: &[]string{*instance.InstanceID},
+		}, asyncop.CancelChannel(ctx))
+		onErrorFail(asyncop.Do(ctx, "UpdateInstances '"+*instance.InstanceID+"'", errChan), "UpdateInstances '%s' failed", *instance.InstanceID)
+	}
+}
+
+// listVMSSinstanceViews prints every status (such as provisioning and power state) from the
+// instance view of every instance in the scale set.
+func listVMSSinstanceViews(name string) {
+	fmt.Printf("List instance views of VM scale set '%s'...\n", name)
+	instances, err := vmssVMsClient.List(groupName, name, "", "", "")
+	onErrorFail(err, "List instances of '%s' failed", name)
+
+	if instances.Value == nil {
+		fmt.Println("There are no instances in this scale set")
+		return
+	}
+	for _, instance := range *instances.Value {
+		view, err := vmssVMsClient.GetInstanceView(groupName, name, *instance.InstanceID)
+		onErrorFail(err, "GetInstanceView '%s' failed", *instance.InstanceID)
+
+		fmt.Printf("Instance '%s'\n", *instance.InstanceID)
+		if view.Statuses != nil {
+			for _, status := range *view.Statuses {
+				fmt.Printf("\t%s\n", *status.DisplayStatus)
+			}
+		}
+	}
+}